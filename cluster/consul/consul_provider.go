@@ -1,9 +1,12 @@
 package consul
 
 import (
+	"context"
 	"fmt"
 	"log"
+	"math/rand"
 	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/AsynkronIT/protoactor-go/cluster"
@@ -16,6 +19,101 @@ var (
 	blockingUpdateTTLFunc = blockingUpdateTTL
 )
 
+// maxRenewFailures is how many consecutive session-renew failures we'll
+// tolerate before declaring the session (and therefore this node) fenced.
+const maxRenewFailures = 3
+
+// maxUpdateTTLBackoff caps the exponential backoff the OUTER retry loop in
+// UpdateTTL applies after consecutive failures to refresh the TTL.
+const maxUpdateTTLBackoff = 30 * time.Second
+
+// maxTopologyBatchItems forces an early flush of the pending topology batch
+// once it grows this large, rather than waiting out the full debounce window.
+const maxTopologyBatchItems = 100
+
+// minHeartbeatPeriod replaces a zero or negative WithHeartbeatPeriod, since
+// such a period would make the startup jitter computation panic and would
+// otherwise busy-loop against Consul. Positive periods are used as given.
+const minHeartbeatPeriod = 10 * time.Millisecond
+
+// Option configures optional behavior on top of NewWithConfig's defaults.
+type Option func(*Provider)
+
+// WithFencing enables Consul session-based fencing. RegisterMember will
+// create a session alongside the TTL health check, and UpdateTTL renews it;
+// losing the session marks the provider unhealthy rather than letting a
+// partitioned node keep acting as if it were still a live member.
+func WithFencing() Option {
+	return func(p *Provider) {
+		p.fencingEnabled = true
+	}
+}
+
+// WithHeartbeatPeriod sets how often the provider refreshes its Consul TTL
+// check. Defaults to 1 second.
+func WithHeartbeatPeriod(period time.Duration) Option {
+	return func(p *Provider) {
+		p.heartbeatPeriod = period
+	}
+}
+
+// WithHeartbeatEpsilon adds slack on top of heartbeat*gracePeriodMultiplier
+// when deriving the Consul TTL, absorbing scheduling jitter and network
+// latency without tripping the health check. Defaults to 0.
+func WithHeartbeatEpsilon(epsilon time.Duration) Option {
+	return func(p *Provider) {
+		p.heartbeatEpsilon = epsilon
+	}
+}
+
+// WithGracePeriodMultiplier sets the multiplier applied to the heartbeat
+// period when deriving the Consul TTL (ttl = heartbeat*multiplier+epsilon),
+// following the pattern swarmkit's dispatcher uses for its own heartbeat TTL.
+// Defaults to 3.
+func WithGracePeriodMultiplier(multiplier float64) Option {
+	return func(p *Provider) {
+		p.gracePeriodMultiplier = multiplier
+	}
+}
+
+// WithBlockingQueryTimeout sets how long Consul blocking queries in
+// notifyStatuses are allowed to wait for a change. Defaults to 20 seconds.
+func WithBlockingQueryTimeout(timeout time.Duration) Option {
+	return func(p *Provider) {
+		p.blockingWaitTime = timeout
+	}
+}
+
+// WithDeregisterCriticalAfter sets how long a service may remain critical in
+// Consul before Consul automatically deregisters it. Defaults to 60 seconds.
+func WithDeregisterCriticalAfter(after time.Duration) Option {
+	return func(p *Provider) {
+		p.deregisterCritical = after
+	}
+}
+
+// WithTopologyDebounce sets how long MonitorMemberStatusChanges coalesces
+// consecutive topology changes before publishing a single TopologyEvent and
+// TopologyDelta, rather than publishing one pair per Consul blocking query
+// result. Defaults to 100 milliseconds.
+func WithTopologyDebounce(window time.Duration) Option {
+	return func(p *Provider) {
+		p.topologyDebounce = window
+	}
+}
+
+// WithDrainPropagationDelay sets how long Leave waits, after publishing its
+// own draining status, before deregistering. Leave's own fetchStatuses call
+// only proves that *our* query observed the draining status; it says nothing
+// about whether any other node's MonitorMemberStatusChanges loop has polled
+// Consul since. The wait is bounded by the context passed to Leave. Defaults
+// to 5 seconds.
+func WithDrainPropagationDelay(delay time.Duration) Option {
+	return func(p *Provider) {
+		p.drainPropagationDelay = delay
+	}
+}
+
 type Provider struct {
 	cluster               *cluster.Cluster
 	deregistered          bool
@@ -29,30 +127,77 @@ type Provider struct {
 	client                *api.Client
 	ttl                   time.Duration
 	refreshTTL            time.Duration
+	heartbeatPeriod       time.Duration
+	heartbeatEpsilon      time.Duration
+	gracePeriodMultiplier float64
 	updateTTLWaitGroup    sync.WaitGroup
+	stopCh                chan struct{}
 	deregisterCritical    time.Duration
 	blockingWaitTime      time.Duration
 	statusValue           cluster.MemberStatusValue
 	statusValueSerializer cluster.MemberStatusValueSerializer
 	clusterError          error
+
+	fencingEnabled bool
+	sessionID      string
+	fenced         int32 // atomic bool: 1 once the session is known invalid
+	sessionLost    chan struct{}
+	sessionLostOne sync.Once
+	renewFailures  int
+
+	draining bool
+
+	topologyDebounce      time.Duration
+	drainPropagationDelay time.Duration
+	monitorCancel         context.CancelFunc
+
+	topoMu          sync.Mutex
+	previousMembers map[string]*cluster.MemberStatus
+	pendingJoined   map[string]*cluster.MemberStatus
+	pendingLeft     map[string]*cluster.MemberStatus
+	pendingChanged  map[string]*cluster.MemberStatus
+	pendingTimer    *time.Timer
 }
 
 func New() (*Provider, error) {
 	return NewWithConfig(&api.Config{})
 }
 
-func NewWithConfig(consulConfig *api.Config) (*Provider, error) {
+func NewWithConfig(consulConfig *api.Config, options ...Option) (*Provider, error) {
 	client, err := api.NewClient(consulConfig)
 	if err != nil {
 		return nil, err
 	}
 	p := &Provider{
-		client:             client,
-		ttl:                3 * time.Second,
-		refreshTTL:         1 * time.Second,
-		deregisterCritical: 60 * time.Second,
-		blockingWaitTime:   20 * time.Second,
+		client:                client,
+		heartbeatPeriod:       1 * time.Second,
+		gracePeriodMultiplier: 3,
+		deregisterCritical:    60 * time.Second,
+		blockingWaitTime:      20 * time.Second,
+		stopCh:                make(chan struct{}),
+		sessionLost:           make(chan struct{}),
+		topologyDebounce:      100 * time.Millisecond,
+		drainPropagationDelay: 5 * time.Second,
+		previousMembers:       make(map[string]*cluster.MemberStatus),
+		pendingJoined:         make(map[string]*cluster.MemberStatus),
+		pendingLeft:           make(map[string]*cluster.MemberStatus),
+		pendingChanged:        make(map[string]*cluster.MemberStatus),
+	}
+	for _, option := range options {
+		option(p)
 	}
+
+	// a zero or negative period would make rand.Int63n panic when staggering
+	// the first UpdateTTL tick, and would busy-loop Consul regardless
+	if p.heartbeatPeriod <= 0 {
+		p.heartbeatPeriod = minHeartbeatPeriod
+	}
+
+	// derive the Consul TTL from the heartbeat period, following the pattern
+	// used by orchestrators like swarmkit's dispatcher
+	p.refreshTTL = p.heartbeatPeriod
+	p.ttl = time.Duration(float64(p.heartbeatPeriod)*p.gracePeriodMultiplier) + p.heartbeatEpsilon
+
 	return p, nil
 }
 
@@ -72,6 +217,12 @@ func (p *Provider) RegisterMember(cluster *cluster.Cluster, clusterName string,
 		return err
 	}
 
+	if p.fencingEnabled {
+		if err := p.createSession(); err != nil {
+			return err
+		}
+	}
+
 	// IMPORTANT: do these ops sync directly after registering.
 	// this will ensure that the local node sees its own information upon startup.
 
@@ -98,18 +249,70 @@ func (p *Provider) DeregisterMember() error {
 	return nil
 }
 
+// Leave marks this node as draining, publishes that status locally, then
+// waits drainPropagationDelay (bounded by ctx) before deregistering it, so
+// routers and placement code have a chance to stop assigning new work while
+// in-flight messages are still delivered. It does not confirm that other
+// nodes have actually observed the draining status. It mirrors the agent
+// Leave semantics used by swarmkit and memberlist.
+func (p *Provider) Leave(ctx context.Context) error {
+	p.draining = true
+	if err := p.registerService(); err != nil {
+		return err
+	}
+
+	// bypass the debounce window: publish our own draining status straight
+	// away so it's not sitting behind up to topologyDebounce before anyone
+	// else can observe it
+	joined, left, changed, err := p.fetchStatuses(ctx)
+	if err == nil && (len(joined) > 0 || len(left) > 0 || len(changed) > 0) {
+		p.publishTopology(joined, left, changed)
+	}
+	if ctx.Err() != nil {
+		return ctx.Err()
+	}
+
+	// fetchStatuses only proves that *our* query saw the draining status, not
+	// that any other node's MonitorMemberStatusChanges loop has polled Consul
+	// since -- give the rest of the cluster a chance to do so, bounded by
+	// ctx, before we disappear from the catalog
+	waitForDrainPropagation(ctx, p.drainPropagationDelay)
+
+	if err := p.deregisterService(); err != nil {
+		return err
+	}
+	p.deregistered = true
+	return nil
+}
+
+// waitForDrainPropagation blocks for delay, or until ctx is done, whichever
+// comes first. It's split out of Leave so the ctx-bounding behavior can be
+// unit tested without a live Consul agent.
+func waitForDrainPropagation(ctx context.Context, delay time.Duration) {
+	select {
+	case <-time.After(delay):
+	case <-ctx.Done():
+	}
+}
+
 func (p *Provider) Shutdown() error {
 	if p.shutdown {
 		return nil
 	}
 
 	p.shutdown = true
+	if p.monitorCancel != nil {
+		p.monitorCancel()
+	}
+	close(p.stopCh)
 	p.updateTTLWaitGroup.Wait()
 
 	if !p.deregistered {
-		err := p.DeregisterMember()
-		if err != nil {
-			return err
+		ctx, cancel := context.WithTimeout(context.Background(), p.blockingWaitTime)
+		defer cancel()
+		if err := p.Leave(ctx); err != nil {
+			log.Println("[CLUSTER] [CONSUL] Leave failed, falling back to hard deregister:", err)
+			return p.DeregisterMember()
 		}
 	}
 	return nil
@@ -120,12 +323,27 @@ func (p *Provider) UpdateTTL() {
 		p.updateTTLWaitGroup.Add(1)
 		defer p.updateTTLWaitGroup.Done()
 
+		// stagger the first tick so many nodes registering against the same
+		// Consul cluster at once don't all PUT /v1/agent/check/pass/... together
+		if !p.sleep(time.Duration(rand.Int63n(int64(p.heartbeatPeriod)))) {
+			return
+		}
+
+		backoff := p.refreshTTL
+
 	OUTER:
 		for !p.shutdown {
 
+			if p.fencingEnabled {
+				p.renewSession()
+			}
+
 			err := blockingUpdateTTLFunc(p)
 			if err == nil {
-				time.Sleep(p.refreshTTL)
+				backoff = p.refreshTTL
+				if !p.sleep(p.refreshTTL) {
+					return
+				}
 				continue
 			}
 
@@ -135,7 +353,10 @@ func (p *Provider) UpdateTTL() {
 			for id := range services {
 				if id == p.id {
 					log.Println("[CLUSTER] [CONSUL] Service found in consul -> doing nothing")
-					time.Sleep(p.refreshTTL)
+					if !p.sleep(backoff) {
+						return
+					}
+					backoff = nextBackoff(backoff)
 					continue OUTER
 				}
 			}
@@ -143,16 +364,44 @@ func (p *Provider) UpdateTTL() {
 			err = p.registerService()
 			if err != nil {
 				log.Println("[CLUSTER] [CONSUL] Error reregistering service ", err)
-				time.Sleep(p.refreshTTL)
+				if !p.sleep(backoff) {
+					return
+				}
+				backoff = nextBackoff(backoff)
 				continue
 			}
 
 			log.Println("[CLUSTER] [CONSUL] Reregistered service in consul")
-			time.Sleep(p.refreshTTL)
+			backoff = p.refreshTTL
+			if !p.sleep(backoff) {
+				return
+			}
 		}
 	}()
 }
 
+// sleep waits for d, returning early (and reporting false) if the provider
+// is shut down in the meantime, so Shutdown's wait on updateTTLWaitGroup
+// isn't left blocking for up to the full exponential backoff cap.
+func (p *Provider) sleep(d time.Duration) bool {
+	select {
+	case <-time.After(d):
+		return true
+	case <-p.stopCh:
+		return false
+	}
+}
+
+// nextBackoff doubles the wait between failed UpdateTTL attempts, capped at
+// maxUpdateTTLBackoff, instead of retrying at the heartbeat period forever.
+func nextBackoff(current time.Duration) time.Duration {
+	next := current * 2
+	if next > maxUpdateTTLBackoff {
+		return maxUpdateTTLBackoff
+	}
+	return next
+}
+
 func (p *Provider) UpdateMemberStatusValue(statusValue cluster.MemberStatusValue) error {
 	p.statusValue = statusValue
 	if p.statusValue == nil {
@@ -173,15 +422,20 @@ func blockingUpdateTTL(p *Provider) error {
 }
 
 func (p *Provider) registerService() error {
+	meta := map[string]string{
+		"StatusValue": p.statusValueSerializer.Serialize(p.statusValue),
+	}
+	if p.draining {
+		meta["Status"] = "draining"
+	}
+
 	s := &api.AgentServiceRegistration{
 		ID:      p.id,
 		Name:    p.clusterName,
 		Tags:    p.knownKinds,
 		Address: p.address,
 		Port:    p.port,
-		Meta: map[string]string{
-			"StatusValue": p.statusValueSerializer.Serialize(p.statusValue),
-		},
+		Meta:    meta,
 		Check: &api.AgentServiceCheck{
 			DeregisterCriticalServiceAfter: p.deregisterCritical.String(),
 			TTL:                            p.ttl.String(),
@@ -196,24 +450,41 @@ func (p *Provider) deregisterService() error {
 
 // call this directly after registering the service
 func (p *Provider) blockingStatusChange() {
-	p.notifyStatuses()
+	// the local node forcing its own presence into the first status update
+	// should be visible straight away, so this bypasses the debounce window
+	joined, left, changed, err := p.fetchStatuses(context.Background())
+	if err != nil {
+		log.Printf("Error %v", err)
+		return
+	}
+	if len(joined) == 0 && len(left) == 0 && len(changed) == 0 {
+		return
+	}
+	p.publishTopology(joined, left, changed)
 }
 
-func (p *Provider) notifyStatuses() {
-	statuses, meta, err := p.client.Health().Service(p.clusterName, "", false, &api.QueryOptions{
-		WaitIndex: p.index,
+// fetchStatuses runs a single Consul blocking query and diffs the result
+// against the previously observed snapshot (keyed by memberID), returning
+// only what joined, left or changed.
+func (p *Provider) fetchStatuses(ctx context.Context) (joined, left, changed []*cluster.MemberStatus, err error) {
+	p.topoMu.Lock()
+	waitIndex := p.index
+	p.topoMu.Unlock()
+
+	// the blocking call itself (up to blockingWaitTime) happens outside the
+	// lock so it doesn't stall concurrent callers (e.g. a direct Leave()
+	// racing the MonitorMemberStatusChanges loop) for the whole wait window
+	statuses, meta, err := p.client.Health().Service(p.clusterName, "", false, (&api.QueryOptions{
+		WaitIndex: waitIndex,
 		WaitTime:  p.blockingWaitTime,
-	})
+	}).WithContext(ctx))
 	if err != nil {
-		log.Printf("Error %v", err)
-		return
+		return nil, nil, nil, err
 	}
-	p.index = meta.LastIndex
 
-	res := make(cluster.TopologyEvent, len(statuses))
-	for i, v := range statuses {
-		key := fmt.Sprintf("%v/%v:%v", p.clusterName, v.Service.Address, v.Service.Port)
-		memberID := key
+	current := make(map[string]*cluster.MemberStatus, len(statuses))
+	for _, v := range statuses {
+		memberID := fmt.Sprintf("%v/%v:%v", p.clusterName, v.Service.Address, v.Service.Port)
 		memberStatusVal := p.statusValueSerializer.Deserialize(v.Service.Meta["StatusValue"])
 		ms := &cluster.MemberStatus{
 			MemberID:    memberID,
@@ -221,32 +492,328 @@ func (p *Provider) notifyStatuses() {
 			Port:        v.Service.Port,
 			Kinds:       v.Service.Tags,
 			Alive:       len(v.Checks) > 0 && v.Checks.AggregatedStatus() == api.HealthPassing,
+			Draining:    v.Service.Meta["Status"] == "draining",
 			StatusValue: memberStatusVal,
 		}
-		res[i] = ms
+		current[memberID] = ms
 
 		// Update Tags for this member
 		if memberID == p.id {
 			p.knownKinds = v.Service.Tags
 		}
 	}
-	// the reason why we want this in a batch and not as individual messages is that
-	// if we have an atomic batch, we can calculate what nodes have left the cluster
-	// passing events one by one, we can't know if someone left or just haven't changed status for a long time
 
-	// publish the current cluster topology onto the event stream
+	p.topoMu.Lock()
+	defer p.topoMu.Unlock()
+
+	// only adopt this response's index if it's newer than what another
+	// concurrent caller may have already advanced it to
+	if meta.LastIndex > p.index {
+		p.index = meta.LastIndex
+	}
+
+	joined, left, changed = diffMemberStatuses(current, p.previousMembers, p.statusValueSerializer)
+	p.previousMembers = current
+
+	return joined, left, changed, nil
+}
+
+// diffMemberStatuses compares a freshly fetched snapshot against the
+// previously observed one (both keyed by memberID) and reports what joined,
+// left or changed. It's a pure function so it can be unit tested without a
+// live Consul cluster.
+//
+// StatusValue is compared via its serialized wire form rather than `!=` on
+// the raw interface: MemberStatusValue is documented as an opaque,
+// application-defined payload, and a concrete type backing it that contains
+// a slice, map or func would make `!=` panic at runtime.
+func diffMemberStatuses(current, previous map[string]*cluster.MemberStatus, serializer cluster.MemberStatusValueSerializer) (joined, left, changed []*cluster.MemberStatus) {
+	for memberID, ms := range current {
+		prev, ok := previous[memberID]
+		if !ok {
+			joined = append(joined, ms)
+			continue
+		}
+		if prev.Alive != ms.Alive || prev.Draining != ms.Draining ||
+			serializer.Serialize(prev.StatusValue) != serializer.Serialize(ms.StatusValue) {
+			changed = append(changed, ms)
+		}
+	}
+	for memberID, prev := range previous {
+		if _, ok := current[memberID]; !ok {
+			left = append(left, prev)
+		}
+	}
+	return joined, left, changed
+}
+
+// notifyStatuses runs one blocking query and, if anything changed, queues
+// the diff for debounced publication instead of publishing immediately --
+// a tight loop of blocking queries would otherwise flood the event stream
+// with near-identical topology events.
+func (p *Provider) notifyStatuses(ctx context.Context) error {
+	joined, left, changed, err := p.fetchStatuses(ctx)
+	if err != nil {
+		return err
+	}
+	if len(joined) == 0 && len(left) == 0 && len(changed) == 0 {
+		return nil
+	}
+	p.queueTopologyPublish(joined, left, changed)
+	return nil
+}
+
+// queueTopologyPublish merges a diff into the pending batch and, if no flush
+// is pending yet, arms a timer that flushes it after topologyDebounce; later
+// diffs join that batch without resetting the timer, following the
+// maxBatchItems/maxBatchInterval pattern swarmkit's dispatcher uses to
+// coalesce near-simultaneous updates into a single event.
+func (p *Provider) queueTopologyPublish(joined, left, changed []*cluster.MemberStatus) {
+	p.topoMu.Lock()
+	defer p.topoMu.Unlock()
+
+	// a member can only be pending in one of the three maps at a time -- a
+	// flapping node (e.g. joined then left again within the same debounce
+	// window) must not be reported as both joined/changed and left in the
+	// same coalesced batch
+	for _, ms := range joined {
+		delete(p.pendingLeft, ms.MemberID)
+		delete(p.pendingChanged, ms.MemberID)
+		p.pendingJoined[ms.MemberID] = ms
+	}
+	for _, ms := range left {
+		delete(p.pendingJoined, ms.MemberID)
+		delete(p.pendingChanged, ms.MemberID)
+		p.pendingLeft[ms.MemberID] = ms
+	}
+	for _, ms := range changed {
+		delete(p.pendingJoined, ms.MemberID)
+		delete(p.pendingLeft, ms.MemberID)
+		p.pendingChanged[ms.MemberID] = ms
+	}
+
+	if len(p.pendingJoined)+len(p.pendingLeft)+len(p.pendingChanged) >= maxTopologyBatchItems {
+		if p.pendingTimer != nil {
+			p.pendingTimer.Stop()
+		}
+		p.flushPendingLocked()
+		return
+	}
+
+	if p.pendingTimer == nil {
+		p.pendingTimer = time.AfterFunc(p.topologyDebounce, p.flushPending)
+	}
+}
+
+func (p *Provider) flushPending() {
+	p.topoMu.Lock()
+	defer p.topoMu.Unlock()
+	p.flushPendingLocked()
+}
+
+// flushPendingLocked must be called with topoMu held.
+func (p *Provider) flushPendingLocked() {
+	if p.pendingTimer != nil {
+		p.pendingTimer.Stop()
+		p.pendingTimer = nil
+	}
+	if len(p.pendingJoined) == 0 && len(p.pendingLeft) == 0 && len(p.pendingChanged) == 0 {
+		return
+	}
+
+	joined := mapValues(p.pendingJoined)
+	left := mapValues(p.pendingLeft)
+	changed := mapValues(p.pendingChanged)
+	p.pendingJoined = make(map[string]*cluster.MemberStatus)
+	p.pendingLeft = make(map[string]*cluster.MemberStatus)
+	p.pendingChanged = make(map[string]*cluster.MemberStatus)
+
+	res := make(cluster.TopologyEvent, 0, len(p.previousMembers))
+	for _, ms := range p.previousMembers {
+		res = append(res, ms)
+	}
+
+	p.cluster.ActorSystem.EventStream.Publish(res)
+	p.cluster.ActorSystem.EventStream.Publish(&cluster.TopologyDelta{
+		Joined:        joined,
+		Left:          left,
+		StatusChanged: changed,
+	})
+}
+
+func mapValues(m map[string]*cluster.MemberStatus) []*cluster.MemberStatus {
+	res := make([]*cluster.MemberStatus, 0, len(m))
+	for _, v := range m {
+		res = append(res, v)
+	}
+	return res
+}
+
+// publishTopology publishes a diff immediately, bypassing the debounce
+// window, for the cases that need the result synchronously: forcing our own
+// presence into the very first status update, and Leave announcing our own
+// draining status.
+func (p *Provider) publishTopology(joined, left, changed []*cluster.MemberStatus) {
+	p.topoMu.Lock()
+	defer p.topoMu.Unlock()
+
+	res := make(cluster.TopologyEvent, 0, len(p.previousMembers))
+	for _, ms := range p.previousMembers {
+		res = append(res, ms)
+	}
 	p.cluster.ActorSystem.EventStream.Publish(res)
+	p.cluster.ActorSystem.EventStream.Publish(&cluster.TopologyDelta{
+		Joined:        joined,
+		Left:          left,
+		StatusChanged: changed,
+	})
 }
 
 func (p *Provider) MonitorMemberStatusChanges() {
+	ctx, cancel := context.WithCancel(context.Background())
+	p.monitorCancel = cancel
+
 	go func() {
+		backoff := p.refreshTTL
 		for !p.shutdown {
-			p.notifyStatuses()
+			if err := p.notifyStatuses(ctx); err != nil {
+				if ctx.Err() != nil {
+					return
+				}
+				log.Println("[CLUSTER] [CONSUL] Error polling for member status changes: ", err)
+				select {
+				case <-time.After(backoff):
+					backoff = nextBackoff(backoff)
+				case <-ctx.Done():
+					return
+				}
+				continue
+			}
+			backoff = p.refreshTTL
 		}
 	}()
 }
 
 // GetHealthStatus returns an error if the cluster health status has problems
 func (p *Provider) GetHealthStatus() error {
+	if p.fencingEnabled && atomic.LoadInt32(&p.fenced) == 1 {
+		return fmt.Errorf("consul cluster provider is fenced: session %v is no longer valid", p.sessionID)
+	}
 	return p.clusterError
 }
+
+// createSession creates a Consul session tied to this node's TTL, used to
+// fence off a node that has lost connectivity to Consul from continuing to
+// act as if it were still a healthy member.
+func (p *Provider) createSession() error {
+	se := &api.SessionEntry{
+		Name:      p.id,
+		TTL:       p.ttl.String(),
+		LockDelay: 0,
+		Behavior:  api.SessionBehaviorRelease,
+	}
+	id, _, err := p.client.Session().Create(se, nil)
+	if err != nil {
+		return err
+	}
+	p.sessionID = id
+	return nil
+}
+
+// renewSession is called from the same goroutine that runs UpdateTTL, so it
+// shares that loop's cadence instead of running its own ticker.
+func (p *Provider) renewSession() {
+	entry, _, err := p.client.Session().Renew(p.sessionID, nil)
+	if err != nil {
+		p.renewFailures++
+		log.Printf("[CLUSTER] [CONSUL] Failure renewing session %v: %v", p.sessionID, err)
+		if p.renewFailures >= maxRenewFailures {
+			p.markFenced()
+		}
+		return
+	}
+	if entry == nil {
+		// Consul responds with a 200 and no entry (rather than an error) once
+		// a session has already been invalidated -- there's nothing left to
+		// retry, so fence immediately instead of waiting out maxRenewFailures
+		log.Printf("[CLUSTER] [CONSUL] Session %v no longer exists, fencing", p.sessionID)
+		p.markFenced()
+		return
+	}
+	p.renewFailures = 0
+}
+
+// markFenced flags the provider as unhealthy, closes sessionLost and
+// publishes the full membership snapshot with only the local node flipped to
+// not alive -- same as flushPendingLocked/publishTopology, so subscribers
+// that treat TopologyEvent as the full membership batch don't read this as
+// every other member having left.
+func (p *Provider) markFenced() {
+	if !atomic.CompareAndSwapInt32(&p.fenced, 0, 1) {
+		return
+	}
+	p.sessionLostOne.Do(func() {
+		close(p.sessionLost)
+	})
+
+	p.topoMu.Lock()
+	res := make(cluster.TopologyEvent, 0, len(p.previousMembers)+1)
+	found := false
+	for memberID, ms := range p.previousMembers {
+		if memberID == p.id {
+			fenced := *ms
+			fenced.Alive = false
+			res = append(res, &fenced)
+			found = true
+			continue
+		}
+		res = append(res, ms)
+	}
+	if !found {
+		res = append(res, &cluster.MemberStatus{
+			MemberID:    p.id,
+			Host:        p.address,
+			Port:        p.port,
+			Kinds:       p.knownKinds,
+			Alive:       false,
+			StatusValue: p.statusValue,
+		})
+	}
+	p.topoMu.Unlock()
+
+	p.cluster.ActorSystem.EventStream.Publish(res)
+}
+
+// AcquireLock acquires a named leadership lock tied to this provider's
+// fencing session. The returned channel is closed when the lock (or the
+// underlying session) is lost, so callers can build fenced singletons on top
+// of the same session that guards their cluster membership.
+func (p *Provider) AcquireLock(key string) (<-chan struct{}, error) {
+	if !p.fencingEnabled {
+		return nil, fmt.Errorf("consul cluster provider: fencing must be enabled to acquire a lock")
+	}
+
+	lock, err := p.client.LockOpts(&api.LockOptions{
+		Key:     key,
+		Session: p.sessionID,
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	lost, err := lock.Lock(nil)
+	if err != nil {
+		return nil, err
+	}
+
+	lockLost := make(chan struct{})
+	go func() {
+		select {
+		case <-lost:
+		case <-p.sessionLost:
+		}
+		close(lockLost)
+	}()
+
+	return lockLost, nil
+}
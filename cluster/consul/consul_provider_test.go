@@ -0,0 +1,199 @@
+package consul
+
+import (
+	"context"
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/AsynkronIT/protoactor-go/cluster"
+	"github.com/hashicorp/consul/api"
+)
+
+func TestNextBackoff(t *testing.T) {
+	tests := []struct {
+		name    string
+		current time.Duration
+		want    time.Duration
+	}{
+		{"doubles below the cap", time.Second, 2 * time.Second},
+		{"doubles again", 10 * time.Second, 20 * time.Second},
+		{"clamps at the cap", 20 * time.Second, maxUpdateTTLBackoff},
+		{"stays at the cap", maxUpdateTTLBackoff, maxUpdateTTLBackoff},
+		{"never exceeds the cap", maxUpdateTTLBackoff * 2, maxUpdateTTLBackoff},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := nextBackoff(tt.current); got != tt.want {
+				t.Errorf("nextBackoff(%v) = %v, want %v", tt.current, got, tt.want)
+			}
+		})
+	}
+}
+
+// identitySerializer treats the MemberStatusValue as already being its own
+// wire string, which is enough to exercise diffMemberStatuses' comparisons
+// without depending on any particular application payload type.
+type identitySerializer struct{}
+
+func (identitySerializer) Serialize(v cluster.MemberStatusValue) string {
+	if v == nil {
+		return ""
+	}
+	return v.(string)
+}
+
+func (identitySerializer) Deserialize(s string) cluster.MemberStatusValue {
+	return s
+}
+
+func TestDiffMemberStatuses(t *testing.T) {
+	previous := map[string]*cluster.MemberStatus{
+		"a": {MemberID: "a", Alive: true},
+		"b": {MemberID: "b", Alive: true},
+	}
+	current := map[string]*cluster.MemberStatus{
+		"a": {MemberID: "a", Alive: false}, // flipped to not alive
+		"c": {MemberID: "c", Alive: true},  // new member
+		// "b" is no longer present
+	}
+
+	joined, left, changed := diffMemberStatuses(current, previous, identitySerializer{})
+
+	if len(joined) != 1 || joined[0].MemberID != "c" {
+		t.Errorf("joined = %+v, want just member c", joined)
+	}
+	if len(left) != 1 || left[0].MemberID != "b" {
+		t.Errorf("left = %+v, want just member b", left)
+	}
+	if len(changed) != 1 || changed[0].MemberID != "a" {
+		t.Errorf("changed = %+v, want just member a", changed)
+	}
+}
+
+func TestDiffMemberStatusesNoChange(t *testing.T) {
+	snapshot := map[string]*cluster.MemberStatus{
+		"a": {MemberID: "a", Alive: true},
+	}
+
+	joined, left, changed := diffMemberStatuses(snapshot, snapshot, identitySerializer{})
+
+	if len(joined) != 0 || len(left) != 0 || len(changed) != 0 {
+		t.Errorf("expected no diff for an unchanged snapshot, got joined=%v left=%v changed=%v", joined, left, changed)
+	}
+}
+
+// uncomparableValue has a slice field, so `!=` on an interface{} holding it
+// panics. diffMemberStatuses must compare StatusValue via the serializer's
+// wire form instead, or this test panics.
+type uncomparableValue struct {
+	tags []string
+}
+
+type uncomparableSerializer struct{}
+
+func (uncomparableSerializer) Serialize(v cluster.MemberStatusValue) string {
+	if v == nil {
+		return ""
+	}
+	uv := v.(uncomparableValue)
+	return fmt.Sprintf("%v", uv.tags)
+}
+
+func (uncomparableSerializer) Deserialize(s string) cluster.MemberStatusValue {
+	return uncomparableValue{}
+}
+
+func TestDiffMemberStatusesDoesNotPanicOnUncomparableStatusValue(t *testing.T) {
+	previous := map[string]*cluster.MemberStatus{
+		"a": {MemberID: "a", Alive: true, StatusValue: uncomparableValue{tags: []string{"x"}}},
+	}
+	current := map[string]*cluster.MemberStatus{
+		"a": {MemberID: "a", Alive: true, StatusValue: uncomparableValue{tags: []string{"y"}}},
+	}
+
+	joined, left, changed := diffMemberStatuses(current, previous, uncomparableSerializer{})
+
+	if len(joined) != 0 || len(left) != 0 {
+		t.Errorf("joined = %+v, left = %+v, want none", joined, left)
+	}
+	if len(changed) != 1 || changed[0].MemberID != "a" {
+		t.Errorf("changed = %+v, want just member a", changed)
+	}
+}
+
+func TestWaitForDrainPropagationBoundedByContext(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+
+	start := time.Now()
+	waitForDrainPropagation(ctx, time.Hour)
+	if elapsed := time.Since(start); elapsed > time.Second {
+		t.Errorf("waitForDrainPropagation took %v, want bounded by the context deadline", elapsed)
+	}
+}
+
+func TestWaitForDrainPropagationReturnsAfterDelay(t *testing.T) {
+	start := time.Now()
+	waitForDrainPropagation(context.Background(), 10*time.Millisecond)
+	if elapsed := time.Since(start); elapsed < 10*time.Millisecond {
+		t.Errorf("waitForDrainPropagation returned after %v, want at least the configured delay", elapsed)
+	}
+}
+
+func TestQueueTopologyPublishMergesPendingBatch(t *testing.T) {
+	p, err := NewWithConfig(&api.Config{}, WithTopologyDebounce(time.Hour))
+	if err != nil {
+		t.Fatalf("NewWithConfig: %v", err)
+	}
+
+	a := &cluster.MemberStatus{MemberID: "a"}
+	b := &cluster.MemberStatus{MemberID: "b"}
+	c := &cluster.MemberStatus{MemberID: "c"}
+
+	p.queueTopologyPublish([]*cluster.MemberStatus{a}, nil, nil)
+	p.queueTopologyPublish([]*cluster.MemberStatus{b}, []*cluster.MemberStatus{c}, nil)
+
+	if len(p.pendingJoined) != 2 {
+		t.Errorf("pendingJoined = %v, want 2 entries", p.pendingJoined)
+	}
+	if len(p.pendingLeft) != 1 {
+		t.Errorf("pendingLeft = %v, want 1 entry", p.pendingLeft)
+	}
+	if p.pendingTimer == nil {
+		t.Error("expected queueTopologyPublish to arm a debounce timer")
+	} else {
+		p.pendingTimer.Stop()
+	}
+}
+
+func TestQueueTopologyPublishReconcilesFlappingMember(t *testing.T) {
+	p, err := NewWithConfig(&api.Config{}, WithTopologyDebounce(time.Hour))
+	if err != nil {
+		t.Fatalf("NewWithConfig: %v", err)
+	}
+	defer func() {
+		if p.pendingTimer != nil {
+			p.pendingTimer.Stop()
+		}
+	}()
+
+	a := &cluster.MemberStatus{MemberID: "a"}
+
+	// "a" joins, then changes, then leaves within the same debounce window --
+	// it must end up only in pendingLeft, not in all three maps at once.
+	p.queueTopologyPublish([]*cluster.MemberStatus{a}, nil, nil)
+	p.queueTopologyPublish(nil, nil, []*cluster.MemberStatus{a})
+	p.queueTopologyPublish(nil, []*cluster.MemberStatus{a}, nil)
+
+	if len(p.pendingJoined) != 0 {
+		t.Errorf("pendingJoined = %v, want empty", p.pendingJoined)
+	}
+	if len(p.pendingChanged) != 0 {
+		t.Errorf("pendingChanged = %v, want empty", p.pendingChanged)
+	}
+	if len(p.pendingLeft) != 1 {
+		t.Errorf("pendingLeft = %v, want just member a", p.pendingLeft)
+	}
+}
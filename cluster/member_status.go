@@ -0,0 +1,47 @@
+package cluster
+
+// This file is the sole declaration site for MemberStatus and its related
+// types in this package -- consul_provider.go and memberlist_provider.go both
+// reference these names but neither (nor any other file here) redeclares
+// them, so new fields like Draining and TopologyDelta below belong here too.
+
+// MemberStatusValue is an opaque, application-defined health/status payload
+// attached to a cluster member. Providers never interpret it directly; they
+// only move it around via a MemberStatusValueSerializer.
+type MemberStatusValue interface{}
+
+// MemberStatusValueSerializer converts a MemberStatusValue to and from the
+// wire format providers use to gossip it (e.g. a Consul service Meta value).
+type MemberStatusValueSerializer interface {
+	Serialize(MemberStatusValue) string
+	Deserialize(string) MemberStatusValue
+}
+
+// MemberStatus is a provider's view of a single cluster member.
+type MemberStatus struct {
+	MemberID    string
+	Host        string
+	Port        int
+	Kinds       []string
+	Alive       bool
+	// Draining is true once a member has announced it is leaving gracefully
+	// (see consul.Provider.Leave; the memberlist provider never sets it) but
+	// hasn't been deregistered yet.
+	// Routers and placement code should stop assigning new work to a
+	// draining member while still delivering messages already in flight.
+	Draining    bool
+	StatusValue MemberStatusValue
+}
+
+// TopologyEvent is published on the ActorSystem's EventStream whenever a
+// cluster provider observes a new membership snapshot.
+type TopologyEvent []*MemberStatus
+
+// TopologyDelta is published alongside a TopologyEvent by providers that
+// coalesce multiple membership changes into a single update. It lets
+// subscribers react to what changed without recomputing the diff themselves.
+type TopologyDelta struct {
+	Joined        []*MemberStatus
+	Left          []*MemberStatus
+	StatusChanged []*MemberStatus
+}
@@ -0,0 +1,406 @@
+package memberlist
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"sync"
+	"time"
+
+	"github.com/AsynkronIT/protoactor-go/cluster"
+	"github.com/hashicorp/memberlist"
+)
+
+// maxMetaSize is the hard cap memberlist places on the Meta field of a node.
+// Status values that don't fit are instead exchanged via the push/pull
+// (LocalState/MergeRemoteState) path, which has no such limit.
+const maxMetaSize = 512
+
+var ProviderShuttingDownError = fmt.Errorf("memberlist cluster provider is shutting down")
+
+// nodeMeta is what we pack into memberlist's Meta field (and, when it
+// overflows maxMetaSize, into the push/pull state instead).
+type nodeMeta struct {
+	NodeID      string   `json:"node_id,omitempty"`
+	ClusterName string   `json:"cluster_name"`
+	KnownKinds  []string `json:"known_kinds"`
+	StatusValue []byte   `json:"status_value,omitempty"`
+	Overflowed  bool     `json:"overflowed,omitempty"`
+}
+
+type Provider struct {
+	cluster               *cluster.Cluster
+	deregistered          bool
+	shutdown              bool
+	id                    string
+	clusterName           string
+	address               string
+	port                  int
+	knownKinds            []string
+	seedPeers             []string
+	memberlistConfig      *memberlist.Config
+	list                  *memberlist.Memberlist
+	statusValue           cluster.MemberStatusValue
+	statusValueSerializer cluster.MemberStatusValueSerializer
+	clusterError          error
+
+	mutex    sync.Mutex
+	previous map[string]*cluster.MemberStatus // keyed by memberID: clusterName/host:port
+	overflow map[string]nodeMeta             // keyed by memberlist node name (p.id), filled by MergeRemoteState
+}
+
+// Option configures knobs on top of memberlist's own Config, mirroring the
+// probe/gossip tuning memberlist already exposes.
+type Option func(*Provider)
+
+func WithProbeInterval(interval time.Duration) Option {
+	return func(p *Provider) {
+		p.memberlistConfig.ProbeInterval = interval
+	}
+}
+
+func WithProbeTimeout(timeout time.Duration) Option {
+	return func(p *Provider) {
+		p.memberlistConfig.ProbeTimeout = timeout
+	}
+}
+
+func WithIndirectChecks(checks int) Option {
+	return func(p *Provider) {
+		p.memberlistConfig.IndirectChecks = checks
+	}
+}
+
+func WithSuspicionMult(mult int) Option {
+	return func(p *Provider) {
+		p.memberlistConfig.SuspicionMult = mult
+	}
+}
+
+func WithGossipInterval(interval time.Duration) Option {
+	return func(p *Provider) {
+		p.memberlistConfig.GossipInterval = interval
+	}
+}
+
+// New creates a provider seeded with the given known peers (host:port),
+// using memberlist's LAN defaults.
+func New(seedPeers []string, options ...Option) (*Provider, error) {
+	return NewWithConfig(seedPeers, memberlist.DefaultLANConfig(), options...)
+}
+
+func NewWithConfig(seedPeers []string, memberlistConfig *memberlist.Config, options ...Option) (*Provider, error) {
+	p := &Provider{
+		seedPeers:        seedPeers,
+		memberlistConfig: memberlistConfig,
+		previous:         make(map[string]*cluster.MemberStatus),
+		overflow:         make(map[string]nodeMeta),
+	}
+	for _, option := range options {
+		option(p)
+	}
+	return p, nil
+}
+
+func (p *Provider) RegisterMember(c *cluster.Cluster, clusterName string, address string, port int, knownKinds []string,
+	statusValue cluster.MemberStatusValue, serializer cluster.MemberStatusValueSerializer) error {
+	p.cluster = c
+	p.clusterName = clusterName
+	p.address = address
+	p.port = port
+	p.knownKinds = knownKinds
+	p.statusValue = statusValue
+	p.statusValueSerializer = serializer
+	p.id = fmt.Sprintf("%v@%v:%v", clusterName, address, port)
+
+	p.memberlistConfig.Name = p.id
+	p.memberlistConfig.BindAddr = address
+	p.memberlistConfig.BindPort = port
+	p.memberlistConfig.AdvertiseAddr = address
+	p.memberlistConfig.AdvertisePort = port
+	p.memberlistConfig.Delegate = p
+	p.memberlistConfig.Events = p
+
+	list, err := memberlist.Create(p.memberlistConfig)
+	if err != nil {
+		return err
+	}
+	p.list = list
+
+	if len(p.seedPeers) > 0 {
+		if _, err := p.list.Join(p.seedPeers); err != nil {
+			return err
+		}
+	}
+
+	// IMPORTANT: do this sync directly after registering.
+	// this will ensure that the local node sees its own information upon startup.
+
+	// force our own existence to be part of the first status update
+	p.blockingStatusChange()
+
+	return nil
+}
+
+func (p *Provider) DeregisterMember() error {
+	if p.list == nil {
+		return nil
+	}
+	err := p.list.Leave(p.memberlistConfig.ProbeInterval * 5)
+	if err != nil {
+		fmt.Println(err)
+		return err
+	}
+	p.deregistered = true
+	return nil
+}
+
+func (p *Provider) Shutdown() error {
+	if p.shutdown {
+		return nil
+	}
+	p.shutdown = true
+
+	if !p.deregistered {
+		err := p.DeregisterMember()
+		if err != nil {
+			return err
+		}
+	}
+
+	if p.list != nil {
+		return p.list.Shutdown()
+	}
+	return nil
+}
+
+func (p *Provider) UpdateMemberStatusValue(statusValue cluster.MemberStatusValue) error {
+	p.mutex.Lock()
+	p.statusValue = statusValue
+	p.mutex.Unlock()
+
+	if statusValue == nil {
+		return nil
+	}
+	if p.shutdown {
+		// don't re-register when already in the process of shutting down
+		return ProviderShuttingDownError
+	}
+
+	// broadcasting our own meta change is how consul's re-register is mirrored here
+	p.list.UpdateNode(p.memberlistConfig.ProbeInterval * 5)
+	return nil
+}
+
+// call this directly after joining
+func (p *Provider) blockingStatusChange() {
+	p.notifyStatuses()
+}
+
+// notifyStatuses diffs the current memberlist membership against the
+// previous snapshot and publishes a cluster.TopologyEvent for the result.
+func (p *Provider) notifyStatuses() {
+	if p.list == nil {
+		return
+	}
+
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+
+	current := make(map[string]*cluster.MemberStatus)
+	for _, member := range p.list.Members() {
+		meta, ok := p.decodeMeta(member)
+		if !ok {
+			continue
+		}
+		memberID := fmt.Sprintf("%v/%v:%v", meta.ClusterName, member.Addr.String(), member.Port)
+		current[memberID] = &cluster.MemberStatus{
+			MemberID:    memberID,
+			Host:        member.Addr.String(),
+			Port:        int(member.Port),
+			Kinds:       meta.KnownKinds,
+			Alive:       member.State == memberlist.StateAlive,
+			StatusValue: p.statusValueSerializer.Deserialize(string(meta.StatusValue)),
+		}
+	}
+
+	// diff against the previous snapshot, indexed by memberID, so a tight
+	// sequence of join/update/leave callbacks doesn't republish an identical
+	// topology for every single one of them
+	changed := membersChanged(current, p.previous, p.statusValueSerializer)
+	p.previous = current
+
+	if !changed {
+		return
+	}
+
+	res := make(cluster.TopologyEvent, 0, len(current))
+	for _, ms := range current {
+		res = append(res, ms)
+	}
+
+	// the reason why we want this in a batch and not as individual messages is that
+	// if we have an atomic batch, we can calculate what nodes have left the cluster
+	// passing events one by one, we can't know if someone left or just haven't changed status for a long time
+
+	// publish the current cluster topology onto the event stream
+	p.cluster.ActorSystem.EventStream.Publish(res)
+}
+
+// membersChanged reports whether current differs from previous (both keyed
+// by memberID). It's a pure function so it can be unit tested without a live
+// memberlist cluster.
+//
+// StatusValue is compared via its serialized wire form rather than `!=` on
+// the raw interface: MemberStatusValue is documented as an opaque,
+// application-defined payload, and a concrete type backing it that contains
+// a slice, map or func would make `!=` panic at runtime.
+func membersChanged(current, previous map[string]*cluster.MemberStatus, serializer cluster.MemberStatusValueSerializer) bool {
+	if len(current) != len(previous) {
+		return true
+	}
+	for memberID, ms := range current {
+		prev, ok := previous[memberID]
+		if !ok || prev.Alive != ms.Alive ||
+			serializer.Serialize(prev.StatusValue) != serializer.Serialize(ms.StatusValue) {
+			return true
+		}
+	}
+	for memberID := range previous {
+		if _, ok := current[memberID]; !ok {
+			return true
+		}
+	}
+	return false
+}
+
+// decodeMeta must be called with p.mutex held, since it may consult
+// p.overflow alongside member.Meta.
+func (p *Provider) decodeMeta(member *memberlist.Node) (nodeMeta, bool) {
+	var meta nodeMeta
+	if len(member.Meta) == 0 {
+		return meta, false
+	}
+	if err := json.Unmarshal(member.Meta, &meta); err != nil {
+		log.Printf("[CLUSTER] [MEMBERLIST] Error decoding meta for %v: %v", member.Name, err)
+		return meta, false
+	}
+	if meta.Overflowed {
+		// the full state (including StatusValue) doesn't fit in Meta; it's
+		// exchanged out-of-band via LocalState/MergeRemoteState instead
+		if full, ok := p.overflow[member.Name]; ok {
+			return full, true
+		}
+		// push/pull hasn't synced this node's full state yet
+	}
+	return meta, true
+}
+
+func (p *Provider) MonitorMemberStatusChanges() {
+	go func() {
+		for !p.shutdown {
+			p.notifyStatuses()
+			time.Sleep(p.memberlistConfig.PushPullInterval)
+		}
+	}()
+}
+
+// GetHealthStatus returns an error if the cluster health status has problems
+func (p *Provider) GetHealthStatus() error {
+	return p.clusterError
+}
+
+// NodeMeta implements memberlist.Delegate. It packs our status value and
+// known kinds into the 512-byte Meta field, falling back to the push/pull
+// state exchanged via LocalState/MergeRemoteState when it doesn't fit.
+//
+// memberlist invokes this from its own probe/gossip goroutines, so
+// statusValue/knownKinds are read under p.mutex rather than as bare field
+// reads, matching the lock UpdateMemberStatusValue writes them under.
+func (p *Provider) NodeMeta(limit int) []byte {
+	p.mutex.Lock()
+	clusterName := p.clusterName
+	knownKinds := p.knownKinds
+	meta := nodeMeta{
+		ClusterName: clusterName,
+		KnownKinds:  knownKinds,
+		StatusValue: []byte(p.statusValueSerializer.Serialize(p.statusValue)),
+	}
+	p.mutex.Unlock()
+
+	encoded, err := json.Marshal(meta)
+	if err != nil {
+		log.Printf("[CLUSTER] [MEMBERLIST] Error encoding meta: %v", err)
+		return []byte{}
+	}
+	if len(encoded) > limit || len(encoded) > maxMetaSize {
+		overflow := nodeMeta{ClusterName: clusterName, KnownKinds: knownKinds, Overflowed: true}
+		encoded, _ = json.Marshal(overflow)
+	}
+	return encoded
+}
+
+func (p *Provider) NotifyMsg(msg []byte) {
+	// no point-to-point messages are sent by this provider
+}
+
+func (p *Provider) GetBroadcasts(overhead, limit int) [][]byte {
+	return nil
+}
+
+// LocalState is the push/pull fallback used when NodeMeta's payload would
+// have exceeded the 512-byte cap. Unlike NodeMeta it carries our NodeID so
+// whichever peer receives it in MergeRemoteState knows which member it
+// belongs to.
+//
+// Like NodeMeta, this runs on memberlist's own goroutines, so statusValue/
+// knownKinds are read under p.mutex.
+func (p *Provider) LocalState(join bool) []byte {
+	p.mutex.Lock()
+	meta := nodeMeta{
+		NodeID:      p.id,
+		ClusterName: p.clusterName,
+		KnownKinds:  p.knownKinds,
+		StatusValue: []byte(p.statusValueSerializer.Serialize(p.statusValue)),
+	}
+	p.mutex.Unlock()
+	encoded, err := json.Marshal(meta)
+	if err != nil {
+		log.Printf("[CLUSTER] [MEMBERLIST] Error encoding local state: %v", err)
+		return []byte{}
+	}
+	return encoded
+}
+
+// MergeRemoteState decodes the full state a peer sent via its own LocalState
+// and stashes it by NodeID, so decodeMeta can serve it back out once that
+// peer's Meta has overflowed and only carries the Overflowed stub.
+func (p *Provider) MergeRemoteState(buf []byte, join bool) {
+	var meta nodeMeta
+	if err := json.Unmarshal(buf, &meta); err != nil {
+		log.Printf("[CLUSTER] [MEMBERLIST] Error decoding remote state: %v", err)
+		return
+	}
+	if meta.NodeID == "" {
+		return
+	}
+
+	p.mutex.Lock()
+	p.overflow[meta.NodeID] = meta
+	p.mutex.Unlock()
+}
+
+// NotifyJoin implements memberlist.EventDelegate.
+func (p *Provider) NotifyJoin(node *memberlist.Node) {
+	p.notifyStatuses()
+}
+
+// NotifyUpdate implements memberlist.EventDelegate.
+func (p *Provider) NotifyUpdate(node *memberlist.Node) {
+	p.notifyStatuses()
+}
+
+// NotifyLeave implements memberlist.EventDelegate.
+func (p *Provider) NotifyLeave(node *memberlist.Node) {
+	p.notifyStatuses()
+}
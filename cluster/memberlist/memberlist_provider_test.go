@@ -0,0 +1,114 @@
+package memberlist
+
+import (
+	"testing"
+
+	"github.com/AsynkronIT/protoactor-go/cluster"
+	"github.com/hashicorp/memberlist"
+)
+
+// identitySerializer treats the MemberStatusValue as already being its own
+// wire string, which is enough to exercise membersChanged's comparisons
+// without depending on any particular application payload type.
+type identitySerializer struct{}
+
+func (identitySerializer) Serialize(v cluster.MemberStatusValue) string {
+	if v == nil {
+		return ""
+	}
+	return v.(string)
+}
+
+func (identitySerializer) Deserialize(s string) cluster.MemberStatusValue {
+	return s
+}
+
+func TestMembersChanged(t *testing.T) {
+	previous := map[string]*cluster.MemberStatus{
+		"a": {MemberID: "a", Alive: true},
+		"b": {MemberID: "b", Alive: true},
+	}
+	current := map[string]*cluster.MemberStatus{
+		"a": {MemberID: "a", Alive: false}, // flipped to not alive
+		"b": {MemberID: "b", Alive: true},
+	}
+
+	if !membersChanged(current, previous, identitySerializer{}) {
+		t.Error("expected membersChanged to report a change when a member's Alive flag flips")
+	}
+}
+
+func TestMembersChangedNoChange(t *testing.T) {
+	snapshot := map[string]*cluster.MemberStatus{
+		"a": {MemberID: "a", Alive: true, StatusValue: "ok"},
+	}
+
+	if membersChanged(snapshot, snapshot, identitySerializer{}) {
+		t.Error("expected membersChanged to report no change for an unchanged snapshot")
+	}
+}
+
+func TestMembersChangedJoinAndLeave(t *testing.T) {
+	previous := map[string]*cluster.MemberStatus{
+		"a": {MemberID: "a", Alive: true},
+	}
+	current := map[string]*cluster.MemberStatus{
+		"b": {MemberID: "b", Alive: true},
+	}
+
+	if !membersChanged(current, previous, identitySerializer{}) {
+		t.Error("expected membersChanged to report a change when membership is entirely different")
+	}
+}
+
+func TestDecodeMetaFallsBackToOverflowState(t *testing.T) {
+	p := &Provider{
+		statusValueSerializer: identitySerializer{},
+		overflow: map[string]nodeMeta{
+			"node-a": {
+				NodeID:      "node-a",
+				ClusterName: "mycluster",
+				KnownKinds:  []string{"worker"},
+				StatusValue: []byte("healthy"),
+			},
+		},
+	}
+
+	member := &memberlist.Node{
+		Name: "node-a",
+		Meta: []byte(`{"cluster_name":"mycluster","overflowed":true}`),
+	}
+
+	meta, ok := p.decodeMeta(member)
+	if !ok {
+		t.Fatal("expected decodeMeta to succeed")
+	}
+	if string(meta.StatusValue) != "healthy" {
+		t.Errorf("meta.StatusValue = %q, want the cached overflow state's value", meta.StatusValue)
+	}
+	if len(meta.KnownKinds) != 1 || meta.KnownKinds[0] != "worker" {
+		t.Errorf("meta.KnownKinds = %v, want the cached overflow state's kinds", meta.KnownKinds)
+	}
+}
+
+func TestDecodeMetaOverflowedWithoutCachedStateYet(t *testing.T) {
+	p := &Provider{
+		statusValueSerializer: identitySerializer{},
+		overflow:              map[string]nodeMeta{},
+	}
+
+	member := &memberlist.Node{
+		Name: "node-a",
+		Meta: []byte(`{"cluster_name":"mycluster","overflowed":true}`),
+	}
+
+	// push/pull hasn't synced this node's full state yet -- decodeMeta should
+	// still report ok with the stub meta rather than failing outright.
+	meta, ok := p.decodeMeta(member)
+	if !ok {
+		t.Fatal("expected decodeMeta to succeed with the stub meta")
+	}
+	if len(meta.StatusValue) != 0 {
+		t.Errorf("meta.StatusValue = %q, want empty until push/pull syncs", meta.StatusValue)
+	}
+}